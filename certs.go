@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/ssh"
+)
+
+// Flag to run rotatecert without uploading anything or touching the
+// server, only logging what would happen.
+var certDryRun bool
+
+// Flag to hit Let's Encrypt's staging endpoint instead of production,
+// useful while testing rotatecert changes.
+var certStaging bool
+
+// A single sub-domain's cert-rotation settings, as read from certs.config.
+type certTarget struct {
+	remoteCertDir string // remote directory to upload fullchain.pem/privkey.pem into
+	reloadCommand string // remote command to run after the new cert is in place
+	challengeType string // must currently be 'http-01' (see obtainCertificate)
+}
+
+// Permissions for uploaded cert material.
+const CERT_FILE_PERMS = "0644"
+const CERT_KEY_PERMS = "0600"
+
+// Directory used to cache the ACME account key between runs, so
+// repeated rotations reuse the same Let's Encrypt account.
+const ACME_CACHE_DIRECTORY = "bin/acme-cache"
+
+// Name of the file, under ACME_CACHE_DIRECTORY, the ACME account's
+// private key is persisted to.
+const ACME_ACCOUNT_KEY_FILE = "account.key"
+
+// Rotate the ssl (https) cert for every supported sub-domain that has
+// cert rotation enabled (see getSupportedSubDomains).
+func rotateCert() error {
+	targets, err := loadCertsConfig("certs.config")
+	if err != nil {
+		return err
+	}
+
+	var client *ssh.Client
+	if !certDryRun {
+		config, err := getSshClientConfig()
+		if err != nil {
+			return err
+		}
+
+		client, err = ssh.Dial("tcp", config.tcpAddress, config.clientConfig)
+		if err != nil {
+			fmt.Println("Error: failed to connect to web host")
+			return err
+		}
+		defer client.Close()
+	}
+
+	for subdomain, info := range getSupportedSubDomains() {
+		if !info.supportsCertRotation {
+			continue // this sub-domain doesn't support cert rotation
+		}
+
+		target, found := targets[subdomain]
+		if !found {
+			fmt.Println("Error: no certs.config entry for sub-domain '" + subdomain + "', skipping")
+			continue
+		}
+
+		fmt.Println("Rotating cert for " + info.domain)
+		if err := rotateCertForDomain(client, info.domain, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Run the ACME challenge for [domain], upload the resulting cert/key to
+// the remote host per [target], and reload the remote web server.
+func rotateCertForDomain(client *ssh.Client, domain string, target certTarget) error {
+	fullchainRemotePath := target.remoteCertDir + "/fullchain.pem"
+	privkeyRemotePath := target.remoteCertDir + "/privkey.pem"
+
+	if certDryRun {
+		fmt.Println("  [dry-run] would obtain a new certificate via " + target.challengeType)
+		fmt.Println("  [dry-run] would upload fullchain to " + fullchainRemotePath)
+		fmt.Println("  [dry-run] would upload privkey to " + privkeyRemotePath)
+		fmt.Println("  [dry-run] would run '" + target.reloadCommand + "' on remote host")
+		return nil
+	}
+
+	certPEM, keyPEM, err := obtainCertificate(client, domain, target.challengeType, certStaging)
+	if err != nil {
+		fmt.Println("Error: failed to obtain certificate for '" + domain + "'")
+		return err
+	}
+
+	if err := uploadBytes(client, certPEM, fullchainRemotePath, CERT_FILE_PERMS); err != nil {
+		fmt.Println("Error: failed to upload fullchain.pem for '" + domain + "'")
+		return err
+	}
+	if err := uploadBytes(client, keyPEM, privkeyRemotePath, CERT_KEY_PERMS); err != nil {
+		fmt.Println("Error: failed to upload privkey.pem for '" + domain + "'")
+		return err
+	}
+
+	fmt.Println("  Reloading web server")
+	if err := runRemoteCommandToConsole(client, target.reloadCommand); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Run an ACME challenge for [domain] over [client] and return the
+// issued certificate chain and private key, both PEM-encoded.
+//
+// Let's Encrypt's validator connects to [domain]'s real, public IP -
+// the SSH-managed remote web host, never the machine running this CLI
+// - so the http-01 challenge response is published into the domain's
+// own live site via [client], not served locally. This rules out
+// autocert.Manager (which only ever serves the challenge from the
+// process calling it), so the RFC 8555 order/authorize/finalize flow
+// is driven directly against acme.Client instead.
+func obtainCertificate(client *ssh.Client, domain, challengeType string, staging bool) ([]byte, []byte, error) {
+	// The Let's Encrypt validator fetches http-01 responses from the
+	// domain's live site over plain HTTP; dns-01 would need a DNS
+	// provider's API wired in instead, which doesn't exist here yet.
+	if challengeType != "http-01" {
+		return nil, nil, errors.New("unsupported challenge type '" + challengeType + "', must be 'http-01'")
+	}
+
+	accountKey, err := loadOrCreateAccountKey(filepath.Join(ACME_CACHE_DIRECTORY, ACME_ACCOUNT_KEY_FILE))
+	if err != nil {
+		fmt.Println("Error: failed to load ACME account key")
+		return nil, nil, err
+	}
+
+	acmeClient := &acme.Client{Key: accountKey}
+	if staging {
+		acmeClient.DirectoryURL = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	}
+
+	ctx := context.Background()
+	if _, err := acmeClient.Register(ctx, &acme.Account{}, acme.AcceptTOS); err != nil && err != acme.ErrAccountAlreadyExists {
+		fmt.Println("Error: failed to register ACME account")
+		return nil, nil, err
+	}
+
+	order, err := acmeClient.AuthorizeOrder(ctx, acme.DomainIDs(domain))
+	if err != nil {
+		fmt.Println("Error: failed to create ACME order for '" + domain + "'")
+		return nil, nil, err
+	}
+
+	webRoot := websiteRootPath(client.User(), domain) + "/" + CURRENT_SYMLINK
+	for _, authzURL := range order.AuthzURLs {
+		if err := completeHTTP01Authorization(ctx, client, acmeClient, authzURL, webRoot); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	order, err = acmeClient.WaitOrder(ctx, order.URI)
+	if err != nil {
+		fmt.Println("Error: ACME order for '" + domain + "' never became ready")
+		return nil, nil, err
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{domain}}, certKey)
+	if err != nil {
+		fmt.Println("Error: failed to create certificate request for '" + domain + "'")
+		return nil, nil, err
+	}
+
+	chain, _, err := acmeClient.CreateOrderCert(ctx, order.FinalizeURL, csrDER, true)
+	if err != nil {
+		fmt.Println("Error: failed to finalize certificate for '" + domain + "'")
+		return nil, nil, err
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	keyDER, err := marshalPrivateKey(certKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, keyPEM, nil
+}
+
+// Fetch [authzURL]'s http-01 challenge, publish its response under
+// [webRoot] on the remote host (so Let's Encrypt's validator can reach
+// it at the real domain), and wait for the CA to accept it.
+func completeHTTP01Authorization(ctx context.Context, client *ssh.Client, acmeClient *acme.Client, authzURL, webRoot string) error {
+	authz, err := acmeClient.GetAuthorization(ctx, authzURL)
+	if err != nil {
+		return err
+	}
+	if authz.Status != acme.StatusPending {
+		return nil // already validated, e.g. by a previous run
+	}
+
+	var challenge *acme.Challenge
+	for _, candidate := range authz.Challenges {
+		if candidate.Type == "http-01" {
+			challenge = candidate
+			break
+		}
+	}
+	if challenge == nil {
+		return errors.New("no http-01 challenge offered for '" + authz.Identifier.Value + "'")
+	}
+
+	response, err := acmeClient.HTTP01ChallengeResponse(challenge.Token)
+	if err != nil {
+		return err
+	}
+
+	challengeRemotePath := webRoot + acmeClient.HTTP01ChallengePath(challenge.Token)
+	if err := uploadBytes(client, []byte(response), challengeRemotePath, CERT_FILE_PERMS); err != nil {
+		fmt.Println("Error: failed to publish http-01 challenge response for '" + authz.Identifier.Value + "'")
+		return err
+	}
+	defer runRemoteCommand(client, "rm -f "+challengeRemotePath)
+
+	if _, err := acmeClient.Accept(ctx, challenge); err != nil {
+		fmt.Println("Error: CA rejected http-01 challenge for '" + authz.Identifier.Value + "'")
+		return err
+	}
+	if _, err := acmeClient.WaitAuthorization(ctx, authzURL); err != nil {
+		fmt.Println("Error: http-01 challenge for '" + authz.Identifier.Value + "' never validated")
+		return err
+	}
+
+	return nil
+}
+
+// Load the ACME account's private key from [path], generating and
+// persisting a new one on first use.
+func loadOrCreateAccountKey(path string) (crypto.Signer, error) {
+	if keyBytes, err := os.ReadFile(path); err == nil {
+		block, _ := pem.Decode(keyBytes)
+		if block == nil {
+			return nil, errors.New("malformed ACME account key at '" + path + "'")
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, errors.New("ACME account key at '" + path + "' is not a signing key")
+		}
+		return signer, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := marshalPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// Marshal an ECDSA private key into PKCS#8 DER bytes suitable for PEM
+// encoding.
+func marshalPrivateKey(key crypto.PrivateKey) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		fmt.Println("Error: failed to marshal private key")
+		return nil, err
+	}
+	return der, nil
+}
+
+// Read certs.config, mapping sub-domain -> cert rotation settings.
+// certs.config MUST NOT be source-controlled.
+// certs.config format: one line per sub-domain, pipe-delimited:
+//
+//	<subdomain>|<remote-cert-dir>|<reload-command>|<challenge-type>
+func loadCertsConfig(path string) (map[string]certTarget, error) {
+	configFile, err := os.Open(path)
+	if err != nil {
+		fmt.Println("Error: cert rotation config must be provided in file '" + path + "'")
+		fmt.Println("certs.config format: one line per sub-domain, pipe-delimited:")
+		fmt.Println("  <subdomain>|<remote-cert-dir>|<reload-command>|<challenge-type>")
+		return nil, err
+	}
+	defer configFile.Close()
+
+	targets := make(map[string]certTarget)
+	fileScanner := bufio.NewScanner(configFile)
+	fileScanner.Split(bufio.ScanLines)
+	for fileScanner.Scan() {
+		line := strings.TrimSpace(fileScanner.Text())
+		if len(line) <= 0 || strings.HasPrefix(line, "#") {
+			continue // skip blank lines and comments
+		}
+
+		fields := strings.Split(line, "|")
+		if len(fields) != 4 {
+			fmt.Println("Error: malformed certs.config line (expected 4 pipe-delimited fields): " + line)
+			return nil, errors.New("certs.config error")
+		}
+
+		targets[strings.TrimSpace(fields[0])] = certTarget{
+			remoteCertDir: strings.TrimSpace(fields[1]),
+			reloadCommand: strings.TrimSpace(fields[2]),
+			challengeType: strings.TrimSpace(fields[3]),
+		}
+	}
+
+	return targets, nil
+}
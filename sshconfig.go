@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Helper struct to hold all ssh config information
+type sshConfig struct {
+	clientConfig *ssh.ClientConfig
+	tcpAddress   string
+}
+
+// CLI override for the '~/.ssh/config' host alias to resolve
+// host/user/identity/known_hosts from, when auth includes 'sshconfig'.
+// Takes precedence over ssh.config's 'host' line.
+var sshHostAlias string
+
+// Auth method keywords supported in the 'auth' field of ssh.config.
+const (
+	AUTH_PASSWORD  = "password"
+	AUTH_KEY       = "key"
+	AUTH_AGENT     = "agent"
+	AUTH_SSHCONFIG = "sshconfig"
+)
+
+// Get ssh config from local ssh.config file.
+// ssh.config file MUST NOT be source-controlled (may contain sensitive
+// info like a password or key passphrase).
+//
+// ssh.config format: one 'key=value' pair per line. Supported keys:
+//
+//	username       - ssh username (not needed when auth=sshconfig and the alias declares a user)
+//	auth           - comma-separated auth methods to try, in order: password, key, agent, sshconfig
+//	password       - required when auth includes 'password'
+//	keyfile        - private key path (falls back to the resolved host alias's IdentityFile, if any, when auth includes 'key' and this is omitted)
+//	keypassphrase  - optional passphrase for an encrypted keyfile
+//	host           - ~/.ssh/config host alias, required when auth includes 'sshconfig' (or pass --host on the CLI)
+//	address        - tcp address '[address]:[port]' (derived from ~/.ssh/config when auth includes 'sshconfig' and omitted here)
+//	knownhosts     - path to known_hosts file, or 'insecure' to explicitly skip host key validation (required; there is no insecure-by-default fallback)
+func getSshClientConfig() (*sshConfig, error) {
+	configFile, err := os.Open("ssh.config")
+	if err != nil {
+		fmt.Println("Error: ssh config must be provided in file ssh.config")
+		fmt.Println("ssh.config format: one 'key=value' pair per line, see sshconfig.go for supported keys")
+		return nil, err
+	}
+	defer configFile.Close()
+
+	values, err := parseKeyValueConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	hostAlias := sshHostAlias
+	if len(hostAlias) <= 0 {
+		hostAlias = values["host"]
+	}
+
+	authMethods, err := buildAuthMethods(values, hostAlias)
+	if err != nil {
+		return nil, err
+	}
+
+	username := values["username"]
+	tcpAddress := values["address"]
+	knownHosts := values["knownhosts"]
+
+	if strings.Contains(values["auth"], AUTH_SSHCONFIG) {
+		if len(hostAlias) <= 0 {
+			return nil, errors.New("ssh config error: 'host' (or the --host flag) is required when auth includes 'sshconfig'")
+		}
+
+		if len(username) <= 0 {
+			username = ssh_config.Get(hostAlias, "User")
+		}
+		if len(tcpAddress) <= 0 {
+			tcpAddress = sshConfigAddress(hostAlias)
+		}
+		if len(knownHosts) <= 0 {
+			knownHosts = ssh_config.Get(hostAlias, "UserKnownHostsFile")
+		}
+	}
+
+	if len(username) <= 0 {
+		return nil, errors.New("ssh config error: 'username' is required")
+	}
+	if len(tcpAddress) <= 0 {
+		return nil, errors.New("ssh config error: 'address' is required (or derivable via auth=sshconfig)")
+	}
+
+	hostKeyCallback, err := buildHostKeyCallback(knownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshConfig{
+		&ssh.ClientConfig{
+			User:            username,
+			Auth:            authMethods,
+			HostKeyCallback: hostKeyCallback,
+		},
+		tcpAddress,
+	}, nil
+}
+
+// Build the ordered stack of ssh.AuthMethods to try, based on the
+// comma-separated 'auth' field in ssh.config (defaults to 'password'
+// for backward compatibility with older ssh.config files). [hostAlias],
+// if set, is used to fall back to ~/.ssh/config's IdentityFile when
+// auth includes 'key' and ssh.config has no 'keyfile' of its own.
+func buildAuthMethods(values map[string]string, hostAlias string) ([]ssh.AuthMethod, error) {
+	auth := values["auth"]
+	if len(auth) <= 0 {
+		auth = AUTH_PASSWORD
+	}
+
+	var methods []ssh.AuthMethod
+	for _, method := range strings.Split(auth, ",") {
+		switch strings.TrimSpace(method) {
+		case AUTH_PASSWORD:
+			if len(values["password"]) <= 0 {
+				return nil, errors.New("ssh config error: 'password' is required when auth includes 'password'")
+			}
+			methods = append(methods, ssh.Password(values["password"]))
+		case AUTH_KEY:
+			keyFile := values["keyfile"]
+			if len(keyFile) <= 0 && len(hostAlias) > 0 {
+				keyFile = ssh_config.Get(hostAlias, "IdentityFile")
+			}
+			signer, err := privateKeySigner(keyFile, values["keypassphrase"])
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, ssh.PublicKeys(signer))
+		case AUTH_AGENT:
+			signers, err := sshAgentSigners()
+			if err != nil {
+				return nil, err
+			}
+			methods = append(methods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) { return signers, nil }))
+		case AUTH_SSHCONFIG:
+			// 'sshconfig' only resolves host/user/known_hosts; it stacks no auth
+			// method of its own, so pair it with 'key' or 'agent' in the auth list.
+			continue
+		default:
+			return nil, errors.New("ssh config error: unknown auth method '" + method + "'")
+		}
+	}
+
+	if len(methods) <= 0 {
+		return nil, errors.New("ssh config error: no usable auth method configured")
+	}
+
+	return methods, nil
+}
+
+// Parse a private key file (optionally passphrase-protected) into an
+// ssh.Signer.
+func privateKeySigner(keyFile, passphrase string) (ssh.Signer, error) {
+	if len(keyFile) <= 0 {
+		return nil, errors.New("ssh config error: 'keyfile' is required when auth includes 'key'")
+	}
+
+	keyBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		fmt.Println("Error: unable to read private key file '" + keyFile + "'")
+		return nil, err
+	}
+
+	if len(passphrase) > 0 {
+		return ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(passphrase))
+	}
+	return ssh.ParsePrivateKey(keyBytes)
+}
+
+// Get the signers offered by a running ssh-agent, via SSH_AUTH_SOCK.
+func sshAgentSigners() ([]ssh.Signer, error) {
+	socketPath := os.Getenv("SSH_AUTH_SOCK")
+	if len(socketPath) <= 0 {
+		return nil, errors.New("ssh config error: auth includes 'agent' but SSH_AUTH_SOCK is not set")
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		fmt.Println("Error: unable to connect to ssh-agent at '" + socketPath + "'")
+		return nil, err
+	}
+
+	return agent.NewClient(conn).Signers()
+}
+
+// Build the tcp '[address]:[port]' for a ~/.ssh/config host alias.
+func sshConfigAddress(hostAlias string) string {
+	hostname := ssh_config.Get(hostAlias, "Hostname")
+	if len(hostname) <= 0 {
+		hostname = hostAlias
+	}
+	port := ssh_config.Get(hostAlias, "Port")
+	if len(port) <= 0 {
+		port = "22"
+	}
+	return hostname + ":" + port
+}
+
+// Build a host key callback from either an explicit known_hosts path or
+// the literal 'insecure'. Unlike the other ssh.config fields, this one
+// has no implicit fallback: a missing or typo'd 'knownhosts' must fail
+// closed rather than silently skip host key validation.
+func buildHostKeyCallback(knownHosts string) (ssh.HostKeyCallback, error) {
+	if len(knownHosts) <= 0 {
+		return nil, errors.New("ssh config error: 'knownhosts' is required (path to a known_hosts file, or 'insecure' to explicitly skip host key validation)")
+	}
+
+	if knownHosts == INSECURE_MODE {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	callback, err := knownhosts.New(knownHosts)
+	if err != nil {
+		fmt.Println("Error: problem parsing ssh known_hosts file")
+		return nil, err
+	}
+	return callback, nil
+}
+
+// Parse a simple 'key=value' config file, one pair per line. Blank
+// lines and lines starting with '#' are ignored.
+func parseKeyValueConfig(file *os.File) (map[string]string, error) {
+	values := make(map[string]string)
+
+	fileScanner := bufio.NewScanner(file)
+	fileScanner.Split(bufio.ScanLines)
+	for fileScanner.Scan() {
+		line := strings.TrimSpace(fileScanner.Text())
+		if len(line) <= 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			fmt.Println("Error: malformed ssh.config line (expected 'key=value'): " + line)
+			return nil, errors.New("ssh config error")
+		}
+
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return values, nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Uploader abstracts the storage backend a built website is deployed
+// to, so upload()/rollback()/listreleases() don't need to know whether
+// they're talking to a web host over SSH, an S3-compatible bucket, or a
+// local directory (for dev/testing).
+//
+// [remoteRoot] is a backend-agnostic identifier for where the site
+// lives (currently always the sub-domain's full domain name); each
+// backend maps it to its own notion of a location (a remote filesystem
+// path, a bucket key prefix, a local directory, etc.).
+type Uploader interface {
+	Upload(ctx context.Context, localDir, remoteRoot string) error
+	Download(ctx context.Context, remoteRoot, localDir string) error
+	Delete(ctx context.Context, remoteRoot string) error
+	List(ctx context.Context, remoteRoot string) ([]string, error)
+}
+
+// ReleaseManager is implemented by Uploaders that support atomic,
+// multi-generation releases (currently only the ssh backend, see
+// uploader_ssh.go). Backends without release support can still be used
+// for plain upload/download/delete.
+type ReleaseManager interface {
+	Rollback(ctx context.Context, remoteRoot, generation string) error
+	CurrentRelease(ctx context.Context, remoteRoot string) (string, error)
+}
+
+// Backend identifiers usable in a sub-domain's 'backend' field.
+const (
+	BACKEND_SSH   = "ssh"
+	BACKEND_S3    = "s3"
+	BACKEND_LOCAL = "local"
+)
+
+// Build the Uploader configured for [info]'s backend.
+func newUploader(info subDomainInfo) (Uploader, error) {
+	switch info.backend {
+	case "", BACKEND_SSH:
+		return newSshUploader()
+	case BACKEND_S3:
+		return newS3Uploader(info.backendConfig)
+	case BACKEND_LOCAL:
+		return newLocalUploader(info.backendConfig)
+	default:
+		return nil, errors.New("unknown backend '" + info.backend + "'")
+	}
+}
+
+// Close [uploader] if its backend holds an open connection (e.g. ssh).
+func closeUploader(uploader Uploader) {
+	if closer, ok := uploader.(io.Closer); ok {
+		closer.Close()
+	}
+}
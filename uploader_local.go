@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// localUploader implements Uploader against a local directory, for
+// dev/testing without a real server or cloud account. It does not
+// implement ReleaseManager.
+type localUploader struct {
+	root string
+}
+
+// newLocalUploader builds a localUploader from a sub-domain's
+// backendConfig. Recognized keys: root (required) - local directory
+// under which each sub-domain gets its own folder.
+func newLocalUploader(backendConfig map[string]string) (*localUploader, error) {
+	root := backendConfig["root"]
+	if len(root) <= 0 {
+		return nil, errors.New("local backend requires a 'root' setting")
+	}
+	return &localUploader{root: root}, nil
+}
+
+func (u *localUploader) Upload(ctx context.Context, localDir, remoteRoot string) error {
+	destination := u.root + "/" + remoteRoot
+	if err := os.RemoveAll(destination); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(localDir, func(path string, file fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if file.IsDir() {
+			return nil
+		}
+
+		relPath := strings.TrimPrefix(path, localDir+"/")
+		return copyLocalFile(path, destination+"/"+relPath)
+	})
+}
+
+func (u *localUploader) Download(ctx context.Context, remoteRoot, localDir string) error {
+	source := u.root + "/" + remoteRoot
+	return filepath.WalkDir(source, func(path string, file fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if file.IsDir() {
+			return nil
+		}
+
+		relPath := strings.TrimPrefix(path, source+"/")
+		return copyLocalFile(path, localDir+"/"+relPath)
+	})
+}
+
+func (u *localUploader) Delete(ctx context.Context, remoteRoot string) error {
+	return os.RemoveAll(u.root + "/" + remoteRoot)
+}
+
+func (u *localUploader) List(ctx context.Context, remoteRoot string) ([]string, error) {
+	root := u.root + "/" + remoteRoot
+
+	var files []string
+	err := filepath.WalkDir(root, func(path string, file fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if !file.IsDir() {
+			files = append(files, strings.TrimPrefix(path, root+"/"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func copyLocalFile(sourcePath, destinationPath string) error {
+	if err := os.MkdirAll(filepath.Dir(destinationPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.Create(destinationPath)
+	if err != nil {
+		return err
+	}
+	defer destination.Close()
+
+	_, err = io.Copy(destination, source)
+	return err
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// s3Uploader implements Uploader against any S3-compatible object
+// store (AWS S3, Cloudflare R2, Backblaze B2, ...) via an endpoint
+// override. It does not implement ReleaseManager: object storage has no
+// atomic symlink-swap equivalent here, so uploads overwrite in place.
+type s3Uploader struct {
+	client *s3.Client
+	bucket string
+}
+
+// newS3Uploader builds an s3Uploader from a sub-domain's backendConfig.
+// Recognized keys: bucket (required), region, endpoint (for R2/B2/etc.),
+// accessKeyID, secretAccessKey (falls back to the default AWS credential
+// chain if omitted).
+func newS3Uploader(backendConfig map[string]string) (*s3Uploader, error) {
+	bucket := backendConfig["bucket"]
+	if len(bucket) <= 0 {
+		return nil, errors.New("s3 backend requires a 'bucket' setting")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(backendConfig["region"]))
+	if err != nil {
+		fmt.Println("Error: failed to load AWS config")
+		return nil, err
+	}
+	if accessKeyID := backendConfig["accessKeyID"]; len(accessKeyID) > 0 {
+		cfg.Credentials = credentials.NewStaticCredentialsProvider(accessKeyID, backendConfig["secretAccessKey"], "")
+	}
+
+	client := s3.NewFromConfig(cfg, func(options *s3.Options) {
+		if endpoint := backendConfig["endpoint"]; len(endpoint) > 0 {
+			options.BaseEndpoint = aws.String(endpoint)
+			options.UsePathStyle = true // required by most S3-compatible endpoints (R2, B2, ...)
+		}
+	})
+
+	return &s3Uploader{client: client, bucket: bucket}, nil
+}
+
+func (u *s3Uploader) Upload(ctx context.Context, localDir, remoteRoot string) error {
+	return filepath.WalkDir(localDir, func(path string, file fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if file.IsDir() {
+			return nil
+		}
+
+		relPath := strings.TrimPrefix(path, localDir+"/")
+		key := remoteRoot + "/" + filepath.ToSlash(relPath)
+
+		body, err := os.Open(path)
+		if err != nil {
+			fmt.Println("Error: unable to open file '" + path + "'")
+			return err
+		}
+		defer body.Close()
+
+		fmt.Println("  Uploading " + path + " to s3://" + u.bucket + "/" + key)
+		_, err = u.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:       aws.String(u.bucket),
+			Key:          aws.String(key),
+			Body:         body,
+			ContentType:  aws.String(contentTypeFor(path)),
+			CacheControl: aws.String(cacheControlFor(path)),
+		})
+		if err != nil {
+			fmt.Println("Error: failed to upload '" + path + "' to s3")
+		}
+		return err
+	})
+}
+
+func (u *s3Uploader) Download(ctx context.Context, remoteRoot, localDir string) error {
+	keys, err := u.List(ctx, remoteRoot)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		destination := localDir + "/" + key
+		if err := u.downloadObject(ctx, remoteRoot+"/"+key, destination); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (u *s3Uploader) Delete(ctx context.Context, remoteRoot string) error {
+	keys, err := u.List(ctx, remoteRoot)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if _, err := u.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(u.bucket),
+			Key:    aws.String(remoteRoot + "/" + key),
+		}); err != nil {
+			fmt.Println("Error: failed to delete 's3://" + u.bucket + "/" + remoteRoot + "/" + key + "'")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// List returns every object key under [remoteRoot], relative to it.
+func (u *s3Uploader) List(ctx context.Context, remoteRoot string) ([]string, error) {
+	var keys []string
+
+	paginator := s3.NewListObjectsV2Paginator(u.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(u.bucket),
+		Prefix: aws.String(remoteRoot + "/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			fmt.Println("Error: failed to list objects under 's3://" + u.bucket + "/" + remoteRoot + "'")
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.ToString(object.Key), remoteRoot+"/"))
+		}
+	}
+
+	return keys, nil
+}
+
+func (u *s3Uploader) downloadObject(ctx context.Context, key, destination string) error {
+	if err := os.MkdirAll(filepath.Dir(destination), os.ModePerm); err != nil {
+		return err
+	}
+
+	output, err := u.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(u.bucket), Key: aws.String(key)})
+	if err != nil {
+		fmt.Println("Error: failed to download 's3://" + u.bucket + "/" + key + "'")
+		return err
+	}
+	defer output.Body.Close()
+
+	file, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(file, output.Body)
+	return err
+}
+
+// Guess the Content-Type for a Hugo build output file.
+func contentTypeFor(path string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(path)); len(contentType) > 0 {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// Cache aggressively for everything except HTML, which we want edits to
+// show up for promptly without needing a cache bust.
+func cacheControlFor(path string) string {
+	if strings.HasSuffix(path, ".html") {
+		return "public, max-age=300"
+	}
+	return "public, max-age=31536000, immutable"
+}
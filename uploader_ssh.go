@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sync/errgroup"
+)
+
+// Number of concurrent SFTP workers to use when uploading a website.
+var uploadConcurrency int
+
+// Flag to skip the content-hash based change detection and re-upload
+// every file, regardless of whether it appears to have changed.
+var forceFullUpload bool
+
+// Number of past releases to retain on the remote host after a
+// successful deploy; older releases are pruned.
+var keepReleases int
+
+// Default number of concurrent SFTP upload workers.
+const DEFAULT_UPLOAD_CONCURRENCY = 8
+
+// Default number of past releases to retain.
+const DEFAULT_KEEP_RELEASES = 5
+
+// Name of the manifest file that records the size, hash, and current
+// remote location of every uploaded file, so future deploys can skip
+// re-transferring files that haven't changed.
+const UPLOAD_MANIFEST_FILE = ".upload-manifest.json"
+
+// Permissions applied to uploaded files.
+const UPLOAD_FILE_PERMS = 0644
+
+// Sub-directory (under the sub-domain's web root) that holds every
+// timestamped release.
+const RELEASES_SUBDIR = "releases"
+
+// Name of the symlink (under the sub-domain's web root) that points at
+// the currently-live release.
+const CURRENT_SYMLINK = "current"
+
+// Format used to name each release directory; sorts lexically in
+// chronological order.
+const RELEASE_TIMESTAMP_FORMAT = "20060102150405"
+
+// sshUploader implements Uploader and ReleaseManager over SSH/SFTP,
+// laying sites out as timestamped release directories with an atomic
+// 'current' symlink swap.
+type sshUploader struct {
+	client   *ssh.Client
+	username string
+}
+
+func newSshUploader() (*sshUploader, error) {
+	fmt.Println("Connecting to web host")
+	config, err := getSshClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := ssh.Dial("tcp", config.tcpAddress, config.clientConfig)
+	if err != nil {
+		fmt.Println("Error: failed to connect to web host")
+		return nil, err
+	}
+
+	return &sshUploader{client: client, username: config.clientConfig.User}, nil
+}
+
+func (u *sshUploader) Close() error {
+	return u.client.Close()
+}
+
+// websiteRoot maps a domain to its path on the remote host, ie.
+// /home/[username]/public_html/simon.duchastel.com
+func (u *sshUploader) websiteRoot(domain string) string {
+	return websiteRootPath(u.username, domain)
+}
+
+// websiteRootPath maps a (username, domain) pair to its path on the
+// remote host, ie. /home/[username]/public_html/simon.duchastel.com.
+// Factored out of websiteRoot so callers that only have an *ssh.Client
+// (e.g. rotatecert, which needs this to serve http-01 challenges from
+// the live site) can compute it without an sshUploader.
+func websiteRootPath(username, domain string) string {
+	return "/home/" + username + "/public_html/" + domain
+}
+
+// Upload the website as a new timestamped release, then atomically
+// swap 'current' to point at it and prune old releases.
+func (u *sshUploader) Upload(ctx context.Context, localDir, remoteRoot string) error {
+	websiteRoot := u.websiteRoot(remoteRoot)
+	timestamp := time.Now().UTC().Format(RELEASE_TIMESTAMP_FORMAT)
+	releasePath := releasesRoot(websiteRoot) + "/" + timestamp
+
+	if err := u.uploadRelease(ctx, localDir, releasePath, websiteRoot+"/"+UPLOAD_MANIFEST_FILE); err != nil {
+		return err
+	}
+
+	fmt.Println("Swapping 'current' to release " + timestamp)
+	if err := swapCurrentSymlink(u.client, websiteRoot, releasePath); err != nil {
+		return err
+	}
+
+	return pruneOldReleases(u.client, websiteRoot, keepReleases)
+}
+
+// Download the files behind 'current' to localDir.
+func (u *sshUploader) Download(ctx context.Context, remoteRoot, localDir string) error {
+	websiteRoot := u.websiteRoot(remoteRoot)
+
+	sftpClient, err := sftp.NewClient(u.client)
+	if err != nil {
+		fmt.Println("Error: failed to create SFTP client")
+		return err
+	}
+	defer sftpClient.Close()
+
+	currentTarget, err := sftpClient.ReadLink(currentSymlinkPath(websiteRoot))
+	if err != nil {
+		fmt.Println("Error: failed to resolve 'current' release")
+		return err
+	}
+
+	walker := sftpClient.Walk(currentTarget)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		if walker.Stat().IsDir() {
+			continue
+		}
+
+		relPath := strings.TrimPrefix(walker.Path(), currentTarget+"/")
+		if err := downloadRemoteFile(sftpClient, walker.Path(), localDir+"/"+relPath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete the entire sub-domain (all releases and the 'current' symlink).
+func (u *sshUploader) Delete(ctx context.Context, remoteRoot string) error {
+	_, err := runRemoteCommand(u.client, "rm -rf "+u.websiteRoot(remoteRoot))
+	return err
+}
+
+// List the release timestamps retained for the sub-domain.
+func (u *sshUploader) List(ctx context.Context, remoteRoot string) ([]string, error) {
+	return listRemoteReleases(u.client, u.websiteRoot(remoteRoot))
+}
+
+// Re-point 'current' at a previous release without re-uploading
+// anything. [generation] is a release timestamp (see List); if empty,
+// the release immediately before the current one is used.
+func (u *sshUploader) Rollback(ctx context.Context, remoteRoot, generation string) error {
+	websiteRoot := u.websiteRoot(remoteRoot)
+
+	releases, err := listRemoteReleases(u.client, websiteRoot)
+	if err != nil {
+		return err
+	}
+	if len(releases) == 0 {
+		return errors.New("no releases found to rollback to")
+	}
+
+	target := generation
+	if target == "" {
+		current, err := currentReleaseTimestamp(u.client, websiteRoot)
+		if err != nil {
+			return err
+		}
+
+		target, err = previousRelease(releases, current)
+		if err != nil {
+			return err
+		}
+	} else if !containsRelease(releases, target) {
+		return errors.New("no such release '" + target + "'")
+	}
+
+	fmt.Println("Rolling back to release " + target)
+	return swapCurrentSymlink(u.client, websiteRoot, releasesRoot(websiteRoot)+"/"+target)
+}
+
+// The release timestamp that 'current' points at.
+func (u *sshUploader) CurrentRelease(ctx context.Context, remoteRoot string) (string, error) {
+	return currentReleaseTimestamp(u.client, u.websiteRoot(remoteRoot))
+}
+
+//////
+// Concurrent SFTP transfer pool
+////////
+
+// Record of a single file's size, content hash, and the remote path it
+// currently lives at, used to detect unchanged files and, when
+// unchanged, to copy them into a new release rather than re-uploading.
+type manifestEntry struct {
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+	Path string `json:"path"`
+}
+
+// A single file queued for upload: its local path and the path it
+// should be uploaded to on the remote host.
+type uploadJob struct {
+	localPath  string
+	remotePath string
+	relPath    string
+}
+
+// Upload [siteToUploadLocation] to [releaseRemoteRoot] over a single
+// SFTP session, using a pool of worker goroutines. Files whose content
+// hash matches the manifest at [manifestRemotePath] are copied
+// server-side from their previous release instead of being
+// re-uploaded, unless forceFullUpload is set.
+func (u *sshUploader) uploadRelease(ctx context.Context, siteToUploadLocation, releaseRemoteRoot, manifestRemotePath string) error {
+	sftpClient, err := sftp.NewClient(u.client)
+	if err != nil {
+		fmt.Println("Error: failed to create SFTP client")
+		return err
+	}
+	defer sftpClient.Close()
+
+	manifest, err := readRemoteManifest(sftpClient, manifestRemotePath)
+	if err != nil {
+		return err
+	}
+
+	jobs, err := collectUploadJobs(siteToUploadLocation, releaseRemoteRoot)
+	if err != nil {
+		return err
+	}
+
+	if err := createDirsAllRemote(u.client, uniqueParentDirs(jobs)); err != nil {
+		return err
+	}
+
+	concurrency := uploadConcurrency
+	if concurrency <= 0 {
+		concurrency = DEFAULT_UPLOAD_CONCURRENCY
+	}
+
+	fmt.Println("Uploading website to web host (" + fmt.Sprint(concurrency) + " workers)")
+
+	var manifestMutex sync.Mutex
+	newManifest := make(map[string]manifestEntry, len(jobs))
+
+	jobChan := make(chan uploadJob)
+	group, groupCtx := errgroup.WithContext(ctx)
+
+	// Send on its own goroutine so a worker failure (which cancels
+	// groupCtx) can stop the sender immediately; otherwise, once every
+	// worker has exited, nothing is left draining jobChan and this send
+	// blocks forever instead of reaching group.Wait().
+	group.Go(func() error {
+		defer close(jobChan)
+		for _, job := range jobs {
+			select {
+			case <-groupCtx.Done():
+				return groupCtx.Err()
+			case jobChan <- job:
+			}
+		}
+		return nil
+	})
+
+	for i := 0; i < concurrency; i++ {
+		group.Go(func() error {
+			for job := range jobChan {
+				select {
+				case <-groupCtx.Done():
+					return groupCtx.Err()
+				default:
+				}
+
+				entry, err := u.uploadJobIfChanged(sftpClient, job, manifest)
+				if err != nil {
+					fmt.Println("Error: failed to upload file '" + job.localPath + "'")
+					return err
+				}
+
+				manifestMutex.Lock()
+				newManifest[job.relPath] = entry
+				manifestMutex.Unlock()
+			}
+			return nil
+		})
+	}
+
+	if err := group.Wait(); err != nil {
+		return err
+	}
+
+	return writeRemoteManifest(sftpClient, manifestRemotePath, newManifest)
+}
+
+// Populate [job] in the new release, either by copying it server-side
+// from its previous release location (if its content hash is unchanged
+// per [manifest]) or by uploading it fresh. Returns the manifest entry
+// to record for it.
+func (u *sshUploader) uploadJobIfChanged(sftpClient *sftp.Client, job uploadJob, manifest map[string]manifestEntry) (manifestEntry, error) {
+	localFile, err := os.Open(job.localPath)
+	if err != nil {
+		fmt.Println("Error: unable to open file '" + job.localPath + "'")
+		return manifestEntry{}, err
+	}
+	defer localFile.Close()
+
+	info, err := localFile.Stat()
+	if err != nil {
+		return manifestEntry{}, err
+	}
+
+	hash, err := hashFile(localFile)
+	if err != nil {
+		return manifestEntry{}, err
+	}
+	entry := manifestEntry{Size: info.Size(), Hash: hash, Path: job.remotePath}
+
+	if !forceFullUpload {
+		if existing, found := manifest[job.relPath]; found && existing.Size == entry.Size && existing.Hash == entry.Hash && existing.Path != "" {
+			if err := copyRemoteFile(u.client, existing.Path, job.remotePath); err == nil {
+				fmt.Println("  Copying (unchanged) " + job.localPath)
+				return entry, nil
+			}
+			// previous release path is gone (e.g. pruned); fall through to a fresh upload
+		}
+	}
+
+	fmt.Println("  Uploading " + job.localPath)
+	if _, err := localFile.Seek(0, io.SeekStart); err != nil {
+		return manifestEntry{}, err
+	}
+
+	remoteFile, err := sftpClient.Create(job.remotePath)
+	if err != nil {
+		fmt.Println("Error: failed to create remote file '" + job.remotePath + "'")
+		return manifestEntry{}, err
+	}
+	defer remoteFile.Close()
+
+	if _, err := io.Copy(remoteFile, localFile); err != nil {
+		fmt.Println("Error: failed to copy '" + job.localPath + "' to remote server")
+		return manifestEntry{}, err
+	}
+
+	if err := sftpClient.Chmod(job.remotePath, UPLOAD_FILE_PERMS); err != nil {
+		fmt.Println("Error: failed to set permissions on '" + job.remotePath + "'")
+		return manifestEntry{}, err
+	}
+
+	return entry, nil
+}
+
+// Copy a file already on the remote host from [sourcePath] to
+// [destinationPath] without transferring its bytes over the SSH
+// connection.
+func copyRemoteFile(sshClient *ssh.Client, sourcePath, destinationPath string) error {
+	_, err := runRemoteCommand(sshClient, "cp -p "+sourcePath+" "+destinationPath)
+	return err
+}
+
+// Download a single remote file via an existing SFTP client, creating
+// any missing local directories.
+func downloadRemoteFile(sftpClient *sftp.Client, remotePath, localPath string) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	remoteFile, err := sftpClient.Open(remotePath)
+	if err != nil {
+		return err
+	}
+	defer remoteFile.Close()
+
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+
+	_, err = io.Copy(localFile, remoteFile)
+	return err
+}
+
+// Compute a hex-encoded SHA-256 hash of [file]'s contents.
+func hashFile(file *os.File) (string, error) {
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// Walk [siteToUploadLocation] and build the list of upload jobs for
+// every regular file found, rooted at [releaseRemoteRoot] on the remote
+// host.
+func collectUploadJobs(siteToUploadLocation, releaseRemoteRoot string) ([]uploadJob, error) {
+	var jobs []uploadJob
+	err := filepath.WalkDir(siteToUploadLocation, func(path string, file fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			fmt.Println("Error: failed to read '" + path + "'")
+			return walkErr
+		}
+		if file.IsDir() {
+			return nil
+		}
+
+		relPath := strings.TrimPrefix(path, siteToUploadLocation+"/")
+		jobs = append(jobs, uploadJob{
+			localPath:  filepath.FromSlash(path),
+			remotePath: releaseRemoteRoot + "/" + filepath.ToSlash(relPath),
+			relPath:    filepath.ToSlash(relPath),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// Return the set of unique parent directories across [jobs], sorted so
+// that a parent always precedes its children. Used to create every
+// remote directory a release needs in a single 'mkdir -p' session
+// instead of one MkdirAll round-trip per file.
+func uniqueParentDirs(jobs []uploadJob) []string {
+	seen := make(map[string]bool, len(jobs))
+	var dirs []string
+	for _, job := range jobs {
+		dir := filepath.ToSlash(filepath.Dir(job.remotePath))
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// Read and parse the upload manifest from the remote host, returning an
+// empty manifest if it doesn't exist yet (e.g. first deploy).
+func readRemoteManifest(sftpClient *sftp.Client, manifestRemotePath string) (map[string]manifestEntry, error) {
+	manifest := make(map[string]manifestEntry)
+
+	remoteFile, err := sftpClient.Open(manifestRemotePath)
+	if err != nil {
+		return manifest, nil // no manifest yet, nothing to compare against
+	}
+	defer remoteFile.Close()
+
+	if err := json.NewDecoder(remoteFile).Decode(&manifest); err != nil {
+		fmt.Println("Error: failed to parse remote upload manifest, ignoring it")
+		return make(map[string]manifestEntry), nil
+	}
+
+	return manifest, nil
+}
+
+// Serialize [manifest] and upload it to the remote host so the next
+// deploy can compare against it.
+func writeRemoteManifest(sftpClient *sftp.Client, manifestRemotePath string, manifest map[string]manifestEntry) error {
+	remoteFile, err := sftpClient.Create(manifestRemotePath)
+	if err != nil {
+		fmt.Println("Error: failed to create remote upload manifest")
+		return err
+	}
+	defer remoteFile.Close()
+
+	if err := json.NewEncoder(remoteFile).Encode(manifest); err != nil {
+		fmt.Println("Error: failed to write remote upload manifest")
+		return err
+	}
+
+	return nil
+}
+
+//////
+// Release management
+////////
+
+// List the release timestamps retained under [websiteRoot], sorted
+// oldest-first.
+func listRemoteReleases(client *ssh.Client, websiteRoot string) ([]string, error) {
+	buffer, err := runRemoteCommand(client, "ls -1 "+releasesRoot(websiteRoot))
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []string
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if len(trimmed) > 0 {
+			releases = append(releases, trimmed)
+		}
+	}
+	sort.Strings(releases)
+
+	return releases, nil
+}
+
+// Return the release timestamp that 'current' points at.
+func currentReleaseTimestamp(client *ssh.Client, websiteRoot string) (string, error) {
+	buffer, err := runRemoteCommand(client, "basename $(readlink "+currentSymlinkPath(websiteRoot)+")")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buffer.String()), nil
+}
+
+// Find the release immediately before [current] in [releases] (sorted
+// oldest-first).
+func previousRelease(releases []string, current string) (string, error) {
+	for i, release := range releases {
+		if release == current && i > 0 {
+			return releases[i-1], nil
+		}
+	}
+	return "", errors.New("no release before '" + current + "' to rollback to")
+}
+
+func containsRelease(releases []string, target string) bool {
+	for _, release := range releases {
+		if release == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Atomically re-point the 'current' symlink under [websiteRoot] at
+// [releasePath].
+func swapCurrentSymlink(client *ssh.Client, websiteRoot, releasePath string) error {
+	_, err := runRemoteCommand(client, "ln -sfn "+releasePath+" "+currentSymlinkPath(websiteRoot))
+	return err
+}
+
+// Delete releases under [websiteRoot] beyond the most recent [keep],
+// leaving 'current' (and whatever it points at) untouched.
+func pruneOldReleases(client *ssh.Client, websiteRoot string, keep int) error {
+	if keep <= 0 {
+		keep = DEFAULT_KEEP_RELEASES
+	}
+
+	releases, err := listRemoteReleases(client, websiteRoot)
+	if err != nil {
+		return err
+	}
+	if len(releases) <= keep {
+		return nil
+	}
+
+	for _, release := range releases[:len(releases)-keep] {
+		fmt.Println("Pruning old release " + release)
+		if _, err := runRemoteCommand(client, "rm -rf "+releasesRoot(websiteRoot)+"/"+release); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func releasesRoot(websiteRoot string) string {
+	return websiteRoot + "/" + RELEASES_SUBDIR
+}
+
+func currentSymlinkPath(websiteRoot string) string {
+	return websiteRoot + "/" + CURRENT_SYMLINK
+}
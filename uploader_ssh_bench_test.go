@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// BenchmarkUploadRelease measures wall-clock time to upload a synthetic
+// 1,000-file tree, to validate that batching remote directory creation
+// (see createDirsAllRemote) actually reduces round-trips rather than
+// just moving them around.
+//
+// It exercises a live sshd rather than pure Go code, so it's skipped
+// unless one is configured via environment variables (e.g. pointed at a
+// local sshd container):
+//
+//	BENCH_SSH_ADDR - host:port of the sshd to upload to
+//	BENCH_SSH_USER - username to authenticate as
+//	BENCH_SSH_KEY  - path to a private key file for that user
+func BenchmarkUploadRelease(b *testing.B) {
+	addr := os.Getenv("BENCH_SSH_ADDR")
+	user := os.Getenv("BENCH_SSH_USER")
+	keyPath := os.Getenv("BENCH_SSH_KEY")
+	if addr == "" || user == "" || keyPath == "" {
+		b.Skip("set BENCH_SSH_ADDR, BENCH_SSH_USER, and BENCH_SSH_KEY to benchmark against a live sshd")
+	}
+
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		b.Fatalf("failed to read %s: %v", keyPath, err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		b.Fatalf("failed to parse private key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		b.Fatalf("failed to connect to %s: %v", addr, err)
+	}
+	defer client.Close()
+
+	siteDir := b.TempDir()
+	const fileCount = 1000
+	const dirFanout = 20
+	for i := 0; i < fileCount; i++ {
+		path := filepath.Join(siteDir, fmt.Sprintf("dir%d", i%dirFanout), fmt.Sprintf("file%d.html", i))
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			b.Fatalf("failed to create synthetic tree: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("<html></html>"), 0644); err != nil {
+			b.Fatalf("failed to create synthetic tree: %v", err)
+		}
+	}
+
+	uploader := &sshUploader{client: client, username: user}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		releaseRoot := fmt.Sprintf("/tmp/upload-bench-%d", i)
+		manifestPath := releaseRoot + "/" + UPLOAD_MANIFEST_FILE
+		if err := uploader.uploadRelease(context.Background(), siteDir, releaseRoot, manifestPath); err != nil {
+			b.Fatalf("uploadRelease failed: %v", err)
+		}
+
+		b.StopTimer()
+		runRemoteCommand(client, "rm -rf "+releaseRoot)
+		b.StartTimer()
+	}
+}